@@ -0,0 +1,173 @@
+package sshd
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"github.com/fsnotify/fsnotify"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// AuthorizedKeysKey is the context key for an AuthorizedKeys store. When
+	// set, Serve wires a PublicKeyCallback onto the ServerConfig that
+	// consults it.
+	AuthorizedKeysKey = "sshd.AuthorizedKeys"
+
+	// pubKeyFingerprintExt is the ssh.Permissions.Extensions key used to
+	// carry the authenticated key's fingerprint from PublicKeyCallback
+	// through to the connection handler.
+	pubKeyFingerprintExt = "pubkey-fp"
+)
+
+// AuthorizedKeys decides whether a given public key is authorized to log in
+// as a given user.
+type AuthorizedKeys interface {
+	// IsAuthorized reports whether key is an authorized credential for user.
+	IsAuthorized(user string, key ssh.PublicKey) bool
+}
+
+// FileAuthorizedKeys is an AuthorizedKeys store backed by a single
+// authorized_keys-formatted file. It watches the file and reloads its
+// contents whenever it changes.
+type FileAuthorizedKeys struct {
+	path string
+
+	mu   sync.RWMutex
+	keys map[string]bool // marshaled public key -> authorized
+
+	watcher *fsnotify.Watcher
+	done    chan struct{}
+}
+
+// NewFileAuthorizedKeys loads path as an authorized_keys file and begins
+// watching it for changes. The returned store is safe for concurrent use.
+func NewFileAuthorizedKeys(path string) (*FileAuthorizedKeys, error) {
+	f := &FileAuthorizedKeys{
+		path: path,
+		keys: map[string]bool{},
+		done: make(chan struct{}),
+	}
+
+	if err := f.Load(); err != nil {
+		return nil, err
+	}
+
+	watcher, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, fmt.Errorf("failed to watch %s: %v", path, err)
+	}
+	// Watch the containing directory rather than path itself: editors and
+	// deploy tooling commonly replace authorized_keys by writing a new file
+	// and renaming it into place, which fsnotify reports as Remove/Rename on
+	// a directly-watched path, silently killing the watch. A directory watch
+	// survives the rename; watch just filters events down to path's name.
+	if err := watcher.Add(filepath.Dir(path)); err != nil {
+		watcher.Close()
+		return nil, fmt.Errorf("failed to watch %s: %v", path, err)
+	}
+	f.watcher = watcher
+
+	go f.watch()
+
+	return f, nil
+}
+
+// Load reads and parses the authorized_keys file, replacing the in-memory
+// set of authorized keys.
+func (f *FileAuthorizedKeys) Load() error {
+	rest, err := ioutil.ReadFile(f.path)
+	if err != nil {
+		return fmt.Errorf("failed to read authorized_keys file %s: %v", f.path, err)
+	}
+
+	keys := map[string]bool{}
+
+	for len(bytes.TrimSpace(rest)) > 0 {
+		var key ssh.PublicKey
+		var parseErr error
+		key, _, _, rest, parseErr = ssh.ParseAuthorizedKey(rest)
+		if parseErr != nil {
+			// No more parseable keys; the remainder is blank lines/comments.
+			break
+		}
+		keys[string(key.Marshal())] = true
+	}
+
+	f.mu.Lock()
+	f.keys = keys
+	f.mu.Unlock()
+
+	return nil
+}
+
+// IsAuthorized reports whether key appears in the authorized_keys file.
+// User is accepted for interface symmetry with real deployments that scope
+// keys per-user, but this file-backed store authorizes any user presenting
+// a listed key.
+func (f *FileAuthorizedKeys) IsAuthorized(user string, key ssh.PublicKey) bool {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	return f.keys[string(key.Marshal())]
+}
+
+// Close stops watching the authorized_keys file.
+func (f *FileAuthorizedKeys) Close() error {
+	close(f.done)
+	if f.watcher != nil {
+		return f.watcher.Close()
+	}
+	return nil
+}
+
+func (f *FileAuthorizedKeys) watch() {
+	name := filepath.Base(f.path)
+	for {
+		select {
+		case <-f.done:
+			return
+		case event, ok := <-f.watcher.Events:
+			if !ok {
+				return
+			}
+			if filepath.Base(event.Name) != name {
+				continue
+			}
+			// Write/Create cover in-place edits; Remove/Rename cover the
+			// rename-into-place pattern (the replacement file lands under
+			// the same name, so it's still visible on this directory
+			// watch). A reload race with the file briefly missing between
+			// the rename's two halves is harmless: Load leaves the old
+			// in-memory keys in place on error, and the Create/Write event
+			// for the new file's arrival triggers another reload right
+			// after.
+			if event.Op&(fsnotify.Write|fsnotify.Create|fsnotify.Remove|fsnotify.Rename) != 0 {
+				f.Load()
+			}
+		case _, ok := <-f.watcher.Errors:
+			if !ok {
+				return
+			}
+		}
+	}
+}
+
+// PublicKeyCallback builds an ssh.ServerConfig.PublicKeyCallback that
+// authorizes a connection against authKeys. On success it stashes the
+// connecting key's fingerprint in the returned Permissions so that
+// handleConn can surface it as cxt:sshKeyFingerprint.
+func PublicKeyCallback(authKeys AuthorizedKeys) func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+	return func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+		if !authKeys.IsAuthorized(conn.User(), key) {
+			return nil, fmt.Errorf("unauthorized key for user %s", conn.User())
+		}
+		return &ssh.Permissions{
+			Extensions: map[string]string{
+				pubKeyFingerprintExt: ssh.FingerprintSHA256(key),
+			},
+		}, nil
+	}
+}
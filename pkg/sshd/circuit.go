@@ -0,0 +1,192 @@
+package sshd
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// CircuitState describes the operational state of a Circuit.
+type CircuitState int
+
+const (
+	// ClosedState indicates the circuit is closed: the server is accepting
+	// and serving connections normally.
+	ClosedState CircuitState = iota
+	// OpenState indicates the circuit is open: the server is not serving
+	// connections, either because it hasn't started or because it failed.
+	OpenState
+	// ClosingState indicates a Shutdown is in progress: the server has
+	// stopped accepting new connections and is draining in-flight exec
+	// commands.
+	ClosingState
+)
+
+// liveSession is a running exec command that Shutdown can wait on or
+// terminate.
+type liveSession struct {
+	conn    *ssh.ServerConn
+	channel ssh.Channel
+	done    chan struct{}
+}
+
+// Circuit tracks the run state of an sshd server using circuit-breaker
+// vocabulary: a Closed circuit is conducting (serving), an Open circuit is
+// not. It also tracks in-flight exec commands so that Shutdown can drain
+// them gracefully.
+type Circuit struct {
+	mu    sync.Mutex
+	state CircuitState
+	stop  func()
+
+	sessions sync.Map // "<hex SessionID()>/<channel pointer>" -> *liveSession
+}
+
+// NewCircuit creates a new Circuit, initially Open until a server closes it.
+func NewCircuit() *Circuit {
+	return &Circuit{state: OpenState}
+}
+
+// State returns the current state of the circuit.
+func (c *Circuit) State() CircuitState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// open marks the circuit as Open.
+func (c *Circuit) open() {
+	c.mu.Lock()
+	c.state = OpenState
+	c.mu.Unlock()
+}
+
+// close marks the circuit as Closed.
+func (c *Circuit) close() {
+	c.mu.Lock()
+	c.state = ClosedState
+	c.mu.Unlock()
+}
+
+// setStopFunc registers the function Serve uses to stop accepting new
+// connections. Shutdown calls it once, before draining in-flight sessions.
+func (c *Circuit) setStopFunc(stop func()) {
+	c.mu.Lock()
+	c.stop = stop
+	c.mu.Unlock()
+}
+
+// trackSession registers a running exec command against conn/channel so
+// Shutdown can wait for it, or signal and close it if it runs past a
+// deadline. The returned func must be called once the command finishes.
+// Several sessions on one connection are tracked separately.
+func (c *Circuit) trackSession(conn *ssh.ServerConn, channel ssh.Channel) func() {
+	key := fmt.Sprintf("%x/%p", conn.SessionID(), channel)
+	ls := &liveSession{conn: conn, channel: channel, done: make(chan struct{})}
+	c.sessions.Store(key, ls)
+	return func() {
+		close(ls.done)
+		c.sessions.Delete(key)
+	}
+}
+
+// shutdownPollInterval is how often Shutdown rescans c.sessions for
+// liveSessions that registered after an earlier scan. A connection that is
+// already past listener.Accept() but still mid-handshake (or mid pty-req/env
+// negotiation) when Shutdown is called hasn't called trackSession yet, so a
+// single Range taken right after stop() would miss it entirely.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown stops the server from accepting new connections, then waits for
+// in-flight exec commands to finish. Any still running when ctx is done are
+// sent an "exit-signal" TERM request and their connection is force-closed.
+// Shutdown returns only once ctx is done; the error it returns is non-nil,
+// with ctx.Err() in its message, only if some session was still running then.
+//
+// Because a connection can be accepted but not yet registered via
+// trackSession (it may still be mid-handshake or mid pty-req/env
+// negotiation) at the moment Shutdown is called, Shutdown rescans
+// c.sessions every shutdownPollInterval until ctx is done rather than
+// relying on a single snapshot, so such a connection is still drained or
+// force-closed on deadline instead of outliving Shutdown entirely.
+func (c *Circuit) Shutdown(ctx context.Context) error {
+	c.mu.Lock()
+	c.state = ClosingState
+	stop := c.stop
+	c.mu.Unlock()
+
+	if stop != nil {
+		stop()
+	}
+
+	var timedOut atomic.Bool
+	var wg sync.WaitGroup
+
+	seen := make(map[string]bool)
+	var seenMu sync.Mutex
+
+	drain := func(ls *liveSession) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case <-ls.done:
+			case <-ctx.Done():
+				timedOut.Store(true)
+				ls.channel.SendRequest("exit-signal", false, ssh.Marshal(exitSignalMsg{Signal: "TERM"}))
+				ls.conn.Close()
+			}
+		}()
+	}
+
+	scan := func() {
+		c.sessions.Range(func(key, value interface{}) bool {
+			k := key.(string)
+			seenMu.Lock()
+			already := seen[k]
+			seen[k] = true
+			seenMu.Unlock()
+			if !already {
+				drain(value.(*liveSession))
+			}
+			return true
+		})
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+pollLoop:
+	for {
+		scan()
+		select {
+		case <-ctx.Done():
+			break pollLoop
+		case <-ticker.C:
+		}
+	}
+	// One last scan to catch anything that registered in the window
+	// between the final tick and ctx being marked done.
+	scan()
+
+	wg.Wait()
+
+	c.open()
+
+	if timedOut.Load() {
+		return fmt.Errorf("shutdown deadline exceeded while draining sessions: %v", ctx.Err())
+	}
+	return nil
+}
+
+// exitSignalMsg is the payload of an "exit-signal" channel request (RFC
+// 4254 6.10), used to tell a client its command was terminated by a signal.
+type exitSignalMsg struct {
+	Signal       string
+	CoreDumped   bool
+	ErrorMessage string
+	LanguageTag  string
+}
@@ -0,0 +1,236 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// LocalPortForwardingCallbackKey is the context key for a
+	// LocalPortForwardingCallback. Client-initiated "direct-tcpip" channels
+	// (ssh -L) are rejected unless this is set and returns true.
+	LocalPortForwardingCallbackKey = "sshd.LocalPortForwardingCallback"
+
+	// ReversePortForwardingCallbackKey is the context key for a
+	// ReversePortForwardingCallback. "tcpip-forward" global requests
+	// (ssh -R) are rejected unless this is set and returns true.
+	ReversePortForwardingCallbackKey = "sshd.ReversePortForwardingCallback"
+)
+
+// LocalPortForwardingCallback decides whether a client may open a
+// direct-tcpip channel to host:port.
+type LocalPortForwardingCallback func(cxt cookoo.Context, host string, port uint32) bool
+
+// ReversePortForwardingCallback decides whether a client may ask the server
+// to listen on host:port and forward accepted connections back to it.
+type ReversePortForwardingCallback func(cxt cookoo.Context, host string, port uint32) bool
+
+// directForwardMsg is the payload of a "direct-tcpip" channel open request.
+type directForwardMsg struct {
+	DestHost   string
+	DestPort   uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// tcpipForwardMsg is the payload of "tcpip-forward"/"cancel-tcpip-forward"
+// global requests.
+type tcpipForwardMsg struct {
+	BindHost string
+	BindPort uint32
+}
+
+// forwardedTCPIPMsg is the payload used to open a "forwarded-tcpip" channel
+// back to the client for a connection accepted on a reverse-forwarded
+// listener.
+type forwardedTCPIPMsg struct {
+	BindHost   string
+	BindPort   uint32
+	OriginHost string
+	OriginPort uint32
+}
+
+// forwardState tracks the reverse-forwarding listeners opened by a single
+// connection so that "cancel-tcpip-forward" and connection teardown can
+// close them.
+type forwardState struct {
+	mu        sync.Mutex
+	listeners map[string]net.Listener
+}
+
+func newForwardState() *forwardState {
+	return &forwardState{listeners: map[string]net.Listener{}}
+}
+
+func (f *forwardState) closeAll() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for addr, l := range f.listeners {
+		l.Close()
+		delete(f.listeners, addr)
+	}
+}
+
+// serveDirectForward services a "direct-tcpip" channel, i.e. local (-L)
+// port forwarding requested by the client.
+func serveDirectForward(newChannel ssh.NewChannel, cxt cookoo.Context) {
+	var payload directForwardMsg
+	if err := ssh.Unmarshal(newChannel.ExtraData(), &payload); err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, "malformed direct-tcpip request")
+		return
+	}
+
+	cb, _ := cxt.Get(LocalPortForwardingCallbackKey, nil).(LocalPortForwardingCallback)
+	if cb == nil || !cb(cxt, payload.DestHost, payload.DestPort) {
+		newChannel.Reject(ssh.Prohibited, "port forwarding is disabled")
+		return
+	}
+
+	dest := fmt.Sprintf("%s:%d", payload.DestHost, payload.DestPort)
+	dconn, err := net.Dial("tcp", dest)
+	if err != nil {
+		newChannel.Reject(ssh.ConnectionFailed, err.Error())
+		return
+	}
+
+	channel, requests, err := newChannel.Accept()
+	if err != nil {
+		dconn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	pipe(channel, dconn)
+}
+
+// serveGlobalRequests answers "tcpip-forward" and "cancel-tcpip-forward"
+// global requests, i.e. remote (-R) port forwarding requested by the
+// client. Unrecognized requests are replied to negatively when a reply is
+// wanted, matching the behavior of discarding requests the server doesn't
+// understand.
+func serveGlobalRequests(reqs <-chan *ssh.Request, sconn *ssh.ServerConn, cxt cookoo.Context, fwd *forwardState) {
+	for req := range reqs {
+		switch req.Type {
+		case "tcpip-forward":
+			handleTCPIPForward(req, sconn, cxt, fwd)
+		case "cancel-tcpip-forward":
+			handleCancelTCPIPForward(req, fwd)
+		default:
+			if req.WantReply {
+				req.Reply(false, nil)
+			}
+		}
+	}
+}
+
+func handleTCPIPForward(req *ssh.Request, sconn *ssh.ServerConn, cxt cookoo.Context, fwd *forwardState) {
+	var payload tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	cb, _ := cxt.Get(ReversePortForwardingCallbackKey, nil).(ReversePortForwardingCallback)
+	if cb == nil || !cb(cxt, payload.BindHost, payload.BindPort) {
+		req.Reply(false, nil)
+		return
+	}
+
+	listener, err := net.Listen("tcp", fmt.Sprintf("%s:%d", payload.BindHost, payload.BindPort))
+	if err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	_, portStr, _ := net.SplitHostPort(listener.Addr().String())
+	var port uint32
+	fmt.Sscanf(portStr, "%d", &port)
+
+	key := fmt.Sprintf("%s:%d", payload.BindHost, port)
+	fwd.mu.Lock()
+	fwd.listeners[key] = listener
+	fwd.mu.Unlock()
+
+	req.Reply(true, ssh.Marshal(struct{ Port uint32 }{port}))
+
+	go acceptForwarded(listener, payload.BindHost, port, sconn)
+}
+
+func acceptForwarded(listener net.Listener, bindHost string, bindPort uint32, sconn *ssh.ServerConn) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			originHost, originPortStr, _ := net.SplitHostPort(conn.RemoteAddr().String())
+			var originPort uint32
+			fmt.Sscanf(originPortStr, "%d", &originPort)
+
+			payload := forwardedTCPIPMsg{
+				BindHost:   bindHost,
+				BindPort:   bindPort,
+				OriginHost: originHost,
+				OriginPort: originPort,
+			}
+
+			channel, requests, err := sconn.OpenChannel("forwarded-tcpip", ssh.Marshal(payload))
+			if err != nil {
+				conn.Close()
+				return
+			}
+			go ssh.DiscardRequests(requests)
+
+			pipe(channel, conn)
+		}()
+	}
+}
+
+func handleCancelTCPIPForward(req *ssh.Request, fwd *forwardState) {
+	var payload tcpipForwardMsg
+	if err := ssh.Unmarshal(req.Payload, &payload); err != nil {
+		req.Reply(false, nil)
+		return
+	}
+
+	key := fmt.Sprintf("%s:%d", payload.BindHost, payload.BindPort)
+	fwd.mu.Lock()
+	listener, ok := fwd.listeners[key]
+	if ok {
+		delete(fwd.listeners, key)
+	}
+	fwd.mu.Unlock()
+
+	if !ok {
+		req.Reply(false, nil)
+		return
+	}
+	listener.Close()
+	req.Reply(true, nil)
+}
+
+// pipe copies data between an SSH channel and a TCP connection until either
+// side closes, then closes both.
+func pipe(channel ssh.Channel, conn net.Conn) {
+	var wg sync.WaitGroup
+	wg.Add(2)
+
+	go func() {
+		defer wg.Done()
+		io.Copy(channel, conn)
+		channel.CloseWrite()
+	}()
+	go func() {
+		defer wg.Done()
+		io.Copy(conn, channel)
+		conn.Close()
+	}()
+
+	wg.Wait()
+	channel.Close()
+}
@@ -0,0 +1,57 @@
+package sshd
+
+import (
+	"fmt"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// SessionHandlerKey is the context key for a SessionHandler. When set,
+	// Serve hands every "session" channel to it instead of dispatching
+	// "exec" commands through cookoo routes.
+	SessionHandlerKey = "sshd.SessionHandler"
+
+	// PublicKeyHandlerKey is the context key for a PublicKeyHandler. It is
+	// a lighter-weight alternative to AuthorizedKeysKey for callers that
+	// want to decide authorization themselves; it is only wired in when no
+	// AuthorizedKeys store is set.
+	PublicKeyHandlerKey = "sshd.PublicKeyHandler"
+
+	// PasswordHandlerKey is the context key for a PasswordHandler.
+	PasswordHandlerKey = "sshd.PasswordHandler"
+)
+
+// PublicKeyHandler decides whether conn may authenticate with key.
+type PublicKeyHandler func(cxt cookoo.Context, conn ssh.ConnMetadata, key ssh.PublicKey) bool
+
+// PasswordHandler decides whether conn may authenticate with password.
+type PasswordHandler func(cxt cookoo.Context, conn ssh.ConnMetadata, password string) bool
+
+// wireHandlers wires any PublicKeyHandler/PasswordHandler present on cxt
+// onto cfg. It does not override a PublicKeyCallback already set by an
+// AuthorizedKeys store (see PublicKeyCallback in auth.go).
+func wireHandlers(cfg *ssh.ServerConfig, cxt cookoo.Context) {
+	if cfg.PublicKeyCallback == nil {
+		if handler, ok := cxt.Get(PublicKeyHandlerKey, nil).(PublicKeyHandler); ok {
+			cfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+				if !handler(cxt, conn, key) {
+					return nil, fmt.Errorf("unauthorized key for user %s", conn.User())
+				}
+				return &ssh.Permissions{
+					Extensions: map[string]string{pubKeyFingerprintExt: ssh.FingerprintSHA256(key)},
+				}, nil
+			}
+		}
+	}
+
+	if handler, ok := cxt.Get(PasswordHandlerKey, nil).(PasswordHandler); ok {
+		cfg.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if !handler(cxt, conn, string(password)) {
+				return nil, fmt.Errorf("incorrect password for user %s", conn.User())
+			}
+			return &ssh.Permissions{}, nil
+		}
+	}
+}
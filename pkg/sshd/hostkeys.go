@@ -0,0 +1,125 @@
+package sshd
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// HostKeyDirKey is the context key for a directory of host key files
+	// (RSA, ECDSA, Ed25519, ...) to load at startup. When set, Serve
+	// publishes a *HostKeyStore on the context under HostKeyStoreKey so
+	// callers can rotate keys later via RotateHostKeys.
+	HostKeyDirKey = "sshd.HostKeyDir"
+
+	// HostKeyStoreKey is the context key Serve publishes the running
+	// *HostKeyStore under, when HostKeyDirKey is set.
+	HostKeyStoreKey = "sshd.HostKeyStore"
+)
+
+// HostKeyStore holds a live *ssh.ServerConfig built from the host keys in a
+// directory, and can reload that directory into a fresh config without
+// disturbing connections already handshaked against the old one.
+type HostKeyStore struct {
+	// template carries every ServerConfig field except host keys; it is
+	// rebuilt from with a new key set on every rotation.
+	template *ssh.ServerConfig
+
+	mu  sync.RWMutex
+	cfg *ssh.ServerConfig
+}
+
+// NewHostKeyStore loads dir's host keys onto a copy of template and returns
+// a HostKeyStore serving that config.
+func NewHostKeyStore(template *ssh.ServerConfig, dir string) (*HostKeyStore, error) {
+	h := &HostKeyStore{template: cloneServerConfig(template)}
+	if err := h.RotateHostKeys(dir); err != nil {
+		return nil, err
+	}
+	return h, nil
+}
+
+// Config returns the ServerConfig currently in effect. New connections
+// should fetch this once per handshake; it may change after a rotation, but
+// already-started handshakes are unaffected.
+func (h *HostKeyStore) Config() *ssh.ServerConfig {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.cfg
+}
+
+// RotateHostKeys loads every host key in dir into a freshly built
+// ServerConfig and atomically swaps it in. Connections that have already
+// handshaked keep using the config (and host key) they started with; only
+// subsequent connections observe the new keys.
+func (h *HostKeyStore) RotateHostKeys(dir string) error {
+	signers, err := loadHostKeysDir(dir)
+	if err != nil {
+		return err
+	}
+
+	next := cloneServerConfig(h.template)
+	for _, signer := range signers {
+		next.AddHostKey(signer)
+	}
+
+	h.mu.Lock()
+	h.cfg = next
+	h.mu.Unlock()
+
+	return nil
+}
+
+// loadHostKeysDir parses every file in dir as an SSH private key, so a
+// directory holding RSA, ECDSA, and Ed25519 keys side by side is loaded as
+// one set of host keys. Files that don't parse as a private key (e.g. the
+// matching ".pub" files) are silently skipped.
+func loadHostKeysDir(dir string) ([]ssh.Signer, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read host key directory %s: %v", dir, err)
+	}
+
+	var signers []ssh.Signer
+	for _, entry := range entries {
+		if entry.IsDir() {
+			continue
+		}
+		data, err := ioutil.ReadFile(filepath.Join(dir, entry.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read host key %s: %v", entry.Name(), err)
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			continue
+		}
+		signers = append(signers, signer)
+	}
+
+	if len(signers) == 0 {
+		return nil, fmt.Errorf("no host keys found in %s", dir)
+	}
+
+	return signers, nil
+}
+
+// cloneServerConfig copies every field of cfg except its host keys, which
+// are unexported and only reachable through AddHostKey.
+func cloneServerConfig(cfg *ssh.ServerConfig) *ssh.ServerConfig {
+	return &ssh.ServerConfig{
+		Config:                      cfg.Config,
+		NoClientAuth:                cfg.NoClientAuth,
+		MaxAuthTries:                cfg.MaxAuthTries,
+		PasswordCallback:            cfg.PasswordCallback,
+		PublicKeyCallback:           cfg.PublicKeyCallback,
+		KeyboardInteractiveCallback: cfg.KeyboardInteractiveCallback,
+		AuthLogCallback:             cfg.AuthLogCallback,
+		ServerVersion:               cfg.ServerVersion,
+		BannerCallback:              cfg.BannerCallback,
+		GSSAPIWithMICConfig:         cfg.GSSAPIWithMICConfig,
+	}
+}
@@ -0,0 +1,85 @@
+package sshd
+
+import (
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Masterminds/cookoo"
+)
+
+// LoggerKey is the context key for a Logger. When set, Serve gives each
+// accepted connection a child logger pre-populated with connection fields
+// and puts it on the per-connection context as "logger", so cookoo commands
+// can pick it up with cookoo.Param{Name: "logger", From: "cxt:logger"}.
+const LoggerKey = "sshd.Logger"
+
+// Logger is a minimal structured logging interface. It is deliberately
+// small so that logrus, zap, or slog can each be wrapped in a thin adapter
+// satisfying it; StdLogger below is the adapter for the standard library's
+// log package.
+type Logger interface {
+	// With returns a child Logger with the given alternating key/value
+	// pairs added to every line it logs.
+	With(kv ...interface{}) Logger
+
+	Debugf(format string, args ...interface{})
+	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
+}
+
+// nopLogger discards everything. It's the default used when no Logger is
+// set on the context.
+type nopLogger struct{}
+
+func (nopLogger) With(kv ...interface{}) Logger { return nopLogger{} }
+func (nopLogger) Debugf(string, ...interface{}) {}
+func (nopLogger) Infof(string, ...interface{})  {}
+func (nopLogger) Errorf(string, ...interface{}) {}
+
+// StdLogger adapts the standard library's *log.Logger to Logger, rendering
+// fields as "key=value" pairs ahead of the formatted message.
+type StdLogger struct {
+	*log.Logger
+	fields []interface{}
+}
+
+// NewStdLogger returns a StdLogger that writes to os.Stderr.
+func NewStdLogger() *StdLogger {
+	return &StdLogger{Logger: log.New(os.Stderr, "", log.LstdFlags)}
+}
+
+func (s *StdLogger) With(kv ...interface{}) Logger {
+	fields := make([]interface{}, 0, len(s.fields)+len(kv))
+	fields = append(fields, s.fields...)
+	fields = append(fields, kv...)
+	return &StdLogger{Logger: s.Logger, fields: fields}
+}
+
+func (s *StdLogger) Debugf(format string, args ...interface{}) { s.logf("DEBUG", format, args...) }
+func (s *StdLogger) Infof(format string, args ...interface{})  { s.logf("INFO", format, args...) }
+func (s *StdLogger) Errorf(format string, args ...interface{}) { s.logf("ERROR", format, args...) }
+
+func (s *StdLogger) logf(level, format string, args ...interface{}) {
+	s.Output(3, level+" "+s.fieldString()+" "+fmt.Sprintf(format, args...))
+}
+
+func (s *StdLogger) fieldString() string {
+	if len(s.fields) == 0 {
+		return ""
+	}
+	out := ""
+	for i := 0; i+1 < len(s.fields); i += 2 {
+		out += fmt.Sprintf("%v=%v ", s.fields[i], s.fields[i+1])
+	}
+	return out
+}
+
+// loggerFrom returns the Logger set on cxt under LoggerKey, or a no-op
+// Logger if none is set.
+func loggerFrom(cxt cookoo.Context) Logger {
+	if l, ok := cxt.Get(LoggerKey, nil).(Logger); ok {
+		return l
+	}
+	return nopLogger{}
+}
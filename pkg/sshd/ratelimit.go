@@ -0,0 +1,282 @@
+package sshd
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// releasingConn wraps a net.Conn so that its handshake slot is released
+// exactly once, the first time the connection is closed.
+type releasingConn struct {
+	net.Conn
+	release func()
+	once    sync.Once
+}
+
+func (c *releasingConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+const (
+	// RateLimitsKey is the context key for a RateLimits. When set, Serve
+	// enforces per-IP connection rate limiting, a global cap on concurrent
+	// handshakes, a handshake timeout, and failed-auth backoff.
+	RateLimitsKey = "sshd.RateLimits"
+
+	// BanlistKey is the context key for the channel Serve publishes
+	// temporarily banned remote IPs on, so operators can subscribe.
+	BanlistKey = "sshd.Banlist"
+)
+
+// RateLimits configures the accept-loop protections Serve applies when
+// present on the context under RateLimitsKey.
+type RateLimits struct {
+	// PerIPRate and PerIPBurst define a token-bucket limit on new
+	// connections per remote IP: PerIPRate tokens/second refill, up to
+	// PerIPBurst tokens held at once.
+	PerIPRate  float64
+	PerIPBurst int
+
+	// MaxConcurrentHandshakes caps how many SSH handshakes may be in
+	// progress at once; connections beyond the cap are rejected outright
+	// rather than queued, so a flood can't pile up goroutines.
+	MaxConcurrentHandshakes int
+
+	// HandshakeTimeout bounds how long a client has to complete the SSH
+	// handshake before the connection is dropped.
+	HandshakeTimeout time.Duration
+
+	// MaxFailedAuth is the number of failed public-key/password attempts
+	// from one IP, within FailedAuthWindow, that triggers a ban lasting
+	// BanDuration.
+	MaxFailedAuth    int
+	FailedAuthWindow time.Duration
+	BanDuration      time.Duration
+}
+
+// RateLimiter enforces a RateLimits policy across an sshd listener.
+type RateLimiter struct {
+	limits RateLimits
+
+	banlist chan string
+
+	handshakeSlots chan struct{}
+
+	mu       sync.Mutex
+	ops      int
+	buckets  map[string]*tokenBucket
+	failures map[string][]time.Time
+	banned   map[string]time.Time
+}
+
+// sweepEvery is how many rate-limiter operations pass between sweeps that
+// evict stale per-IP state, so a long-running server (or a distributed scan
+// using a new source IP per attempt) doesn't grow these maps forever.
+const sweepEvery = 1000
+
+// NewRateLimiter builds a RateLimiter enforcing limits. Its banlist
+// channel (see Banlist) receives an IP string each time it is banned; it is
+// buffered so a slow or absent subscriber never blocks the accept loop.
+func NewRateLimiter(limits RateLimits) *RateLimiter {
+	slots := limits.MaxConcurrentHandshakes
+	if slots <= 0 {
+		slots = 1
+	}
+	return &RateLimiter{
+		limits:         limits,
+		banlist:        make(chan string, 64),
+		handshakeSlots: make(chan struct{}, slots),
+		buckets:        map[string]*tokenBucket{},
+		failures:       map[string][]time.Time{},
+		banned:         map[string]time.Time{},
+	}
+}
+
+// Banlist returns the channel that banned IPs are published on.
+func (r *RateLimiter) Banlist() <-chan string { return r.banlist }
+
+// AllowConnection reports whether a new connection from ip should be
+// accepted: the IP isn't currently banned, and it hasn't exceeded its
+// token-bucket connection rate.
+func (r *RateLimiter) AllowConnection(ip string) bool {
+	if r.isBanned(ip) {
+		return false
+	}
+	return r.bucketFor(ip).allow()
+}
+
+func (r *RateLimiter) isBanned(ip string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	until, ok := r.banned[ip]
+	if !ok {
+		return false
+	}
+	if time.Now().After(until) {
+		delete(r.banned, ip)
+		return false
+	}
+	return true
+}
+
+func (r *RateLimiter) bucketFor(ip string) *tokenBucket {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	b, ok := r.buckets[ip]
+	if !ok {
+		rate := r.limits.PerIPRate
+		burst := float64(r.limits.PerIPBurst)
+		if burst <= 0 {
+			burst = 1
+		}
+		b = &tokenBucket{tokens: burst, rate: rate, burst: burst, last: time.Now()}
+		r.buckets[ip] = b
+	}
+	r.maybeSweepLocked()
+	return b
+}
+
+// maybeSweepLocked evicts buckets and failure records that haven't been
+// touched in a while, so tracking many distinct (often one-shot) source IPs
+// doesn't grow r.buckets/r.failures without bound. Callers must hold r.mu.
+func (r *RateLimiter) maybeSweepLocked() {
+	r.ops++
+	if r.ops%sweepEvery != 0 {
+		return
+	}
+
+	ttl := r.limits.FailedAuthWindow * 10
+	if ttl < time.Hour {
+		ttl = time.Hour
+	}
+	cutoff := time.Now().Add(-ttl)
+
+	for ip, b := range r.buckets {
+		b.mu.Lock()
+		stale := b.last.Before(cutoff)
+		b.mu.Unlock()
+		if stale {
+			delete(r.buckets, ip)
+		}
+	}
+	for ip, attempts := range r.failures {
+		if len(attempts) == 0 || attempts[len(attempts)-1].Before(cutoff) {
+			delete(r.failures, ip)
+		}
+	}
+}
+
+// AcquireHandshakeSlot reserves one of the limited concurrent-handshake
+// slots, returning ok=false immediately if none are free. The returned
+// release func must be called once the handshake attempt finishes.
+func (r *RateLimiter) AcquireHandshakeSlot() (release func(), ok bool) {
+	select {
+	case r.handshakeSlots <- struct{}{}:
+		return func() { <-r.handshakeSlots }, true
+	default:
+		return func() {}, false
+	}
+}
+
+// RecordFailedAuth records a failed public-key/password attempt from ip. If
+// MaxFailedAuth attempts land within FailedAuthWindow, ip is banned for
+// BanDuration and published on the banlist channel.
+func (r *RateLimiter) RecordFailedAuth(ip string) {
+	now := time.Now()
+
+	r.mu.Lock()
+	cutoff := now.Add(-r.limits.FailedAuthWindow)
+	attempts := r.failures[ip]
+	kept := attempts[:0]
+	for _, t := range attempts {
+		if t.After(cutoff) {
+			kept = append(kept, t)
+		}
+	}
+	kept = append(kept, now)
+	r.failures[ip] = kept
+
+	banNow := r.limits.MaxFailedAuth > 0 && len(kept) >= r.limits.MaxFailedAuth
+	if banNow {
+		r.banned[ip] = now.Add(r.limits.BanDuration)
+		delete(r.failures, ip)
+	}
+	r.maybeSweepLocked()
+	r.mu.Unlock()
+
+	if banNow {
+		select {
+		case r.banlist <- ip:
+		default:
+		}
+	}
+}
+
+// tokenBucket is a simple token-bucket rate limiter.
+type tokenBucket struct {
+	mu     sync.Mutex
+	tokens float64
+	rate   float64
+	burst  float64
+	last   time.Time
+}
+
+func (b *tokenBucket) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// remoteIP extracts the host portion of addr, falling back to addr itself
+// if it isn't a host:port pair.
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// wireRateLimiting wraps any PublicKeyCallback/PasswordCallback already set
+// on cfg so that failed attempts are recorded against rl.
+func wireRateLimiting(cfg *ssh.ServerConfig, rl *RateLimiter) {
+	if rl == nil {
+		return
+	}
+
+	if pkCallback := cfg.PublicKeyCallback; pkCallback != nil {
+		cfg.PublicKeyCallback = func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			perms, err := pkCallback(conn, key)
+			if err != nil {
+				rl.RecordFailedAuth(remoteIP(conn.RemoteAddr()))
+			}
+			return perms, err
+		}
+	}
+
+	if pwCallback := cfg.PasswordCallback; pwCallback != nil {
+		cfg.PasswordCallback = func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			perms, err := pwCallback(conn, password)
+			if err != nil {
+				rl.RecordFailedAuth(remoteIP(conn.RemoteAddr()))
+			}
+			return perms, err
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package sshd
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Masterminds/cookoo"
+	"golang.org/x/crypto/ssh"
+)
+
+const (
+	// Address is the context key for the address (host:port) to listen on.
+	Address = "sshd.Address"
+	// ServerConfig is the context key for the *ssh.ServerConfig to serve with.
+	ServerConfig = "sshd.ServerConfig"
+	// Closer is the context key for the channel used to stop a running server.
+	Closer = "sshd.Closer"
+)
+
+// Serve starts an SSH server and blocks until the listener is closed.
+//
+// It expects ServerConfig and Address to already be set on cxt. It puts a
+// Closer channel onto cxt; sending a value on that channel stops the server.
+//
+// Incoming exec requests are dispatched to cookoo routes named "ssh" plus the
+// title-cased first word of the command, e.g. "ping" dispatches to the route
+// "sshPing".
+func Serve(reg *cookoo.Registry, router *cookoo.Router, circuit *Circuit, cxt cookoo.Context) error {
+	cfg := cxt.Get(ServerConfig, nil).(*ssh.ServerConfig)
+	addr := cxt.Get(Address, "0.0.0.0:2022").(string)
+
+	if authKeys, ok := cxt.Get(AuthorizedKeysKey, nil).(AuthorizedKeys); ok {
+		cfg.PublicKeyCallback = PublicKeyCallback(authKeys)
+	}
+	wireHandlers(cfg, cxt)
+
+	var rl *RateLimiter
+	if limits, ok := cxt.Get(RateLimitsKey, nil).(RateLimits); ok {
+		rl = NewRateLimiter(limits)
+		cxt.Put(BanlistKey, rl.Banlist())
+	}
+	wireRateLimiting(cfg, rl)
+
+	var hostKeys *HostKeyStore
+	if dir, ok := cxt.Get(HostKeyDirKey, "").(string); ok && dir != "" {
+		var err error
+		hostKeys, err = NewHostKeyStore(cfg, dir)
+		if err != nil {
+			circuit.open()
+			return err
+		}
+		cxt.Put(HostKeyStoreKey, hostKeys)
+	}
+
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		circuit.open()
+		return fmt.Errorf("failed to listen on %s: %v", addr, err)
+	}
+	defer listener.Close()
+
+	closer := make(chan interface{}, 1)
+	cxt.Put(Closer, closer)
+
+	go func() {
+		<-closer
+		listener.Close()
+	}()
+	circuit.setStopFunc(func() { listener.Close() })
+
+	circuit.close()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			circuit.open()
+			return nil
+		}
+
+		if rl != nil {
+			if !rl.AllowConnection(remoteIP(conn.RemoteAddr())) {
+				conn.Close()
+				continue
+			}
+			release, ok := rl.AcquireHandshakeSlot()
+			if !ok {
+				conn.Close()
+				continue
+			}
+			if rl.limits.HandshakeTimeout > 0 {
+				conn.SetDeadline(time.Now().Add(rl.limits.HandshakeTimeout))
+			}
+			conn = &releasingConn{Conn: conn, release: release}
+		}
+
+		connCfg := cfg
+		if hostKeys != nil {
+			connCfg = hostKeys.Config()
+		}
+		go handleConn(conn, connCfg, circuit, reg, router, cxt)
+	}
+}
+
+// handleConn performs the SSH handshake and services the connection's
+// channels until the client disconnects.
+func handleConn(conn net.Conn, cfg *ssh.ServerConfig, circuit *Circuit, reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Context) {
+	defer conn.Close()
+
+	sconn, chans, reqs, err := ssh.NewServerConn(conn, cfg)
+	if err != nil {
+		return
+	}
+	defer sconn.Close()
+	// Clear the handshake deadline (if any); it must not apply to the rest
+	// of the connection's lifetime.
+	conn.SetDeadline(time.Time{})
+	// The handshake is done, so free its rate-limiter slot now rather than
+	// holding it for the rest of the connection.
+	if rc, ok := conn.(*releasingConn); ok {
+		rc.once.Do(rc.release)
+	}
+
+	connCxt := cxt.Copy()
+	connCxt.Put("sshUser", sconn.User())
+
+	connLogger := loggerFrom(cxt).With(
+		"remote_addr", conn.RemoteAddr().String(),
+		"session_id", fmt.Sprintf("%x", sconn.SessionID()),
+		"user", sconn.User(),
+		"client_version", string(sconn.ClientVersion()),
+	)
+	if sconn.Permissions != nil {
+		fp := sconn.Permissions.Extensions[pubKeyFingerprintExt]
+		connCxt.Put("sshKeyFingerprint", fp)
+		connLogger = connLogger.With("key_fingerprint", fp)
+	}
+	connCxt.Put("logger", connLogger)
+	connLogger.Infof("connection accepted")
+	defer connLogger.Infof("connection closed")
+
+	fwd := newForwardState()
+	defer fwd.closeAll()
+
+	go serveGlobalRequests(reqs, sconn, connCxt, fwd)
+
+	for newChannel := range chans {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go serviceChannel(channel, requests, sconn, circuit, reg, router, connCxt)
+		case "direct-tcpip":
+			go serveDirectForward(newChannel, connCxt)
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+		}
+	}
+}
+
+// serviceChannel handles the requests on a single "session" channel.
+//
+// If a SessionHandler is registered on cxt, the parsed Session is handed to
+// it once the client sends an "exec", "shell", or "subsystem" request.
+// Otherwise it falls back to the legacy behavior of dispatching "exec"
+// commands to cookoo routes named "ssh" + Title(command), e.g. "ping" to
+// route "sshPing".
+func serviceChannel(channel ssh.Channel, requests <-chan *ssh.Request, sconn *ssh.ServerConn, circuit *Circuit, reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Context) {
+	defer channel.Close()
+
+	sess := &session{Channel: channel, conn: sconn}
+
+	handler, hasHandler := cxt.Get(SessionHandlerKey, nil).(SessionHandler)
+
+	sess.handleRequests(requests, func(s *session) {
+		done := circuit.trackSession(sconn, channel)
+		defer done()
+
+		if hasHandler {
+			handler(s)
+			return
+		}
+		runCommand(s.RawCommand(), channel, reg, router, cxt)
+	})
+}
+
+// runCommand dispatches an exec command to its cookoo route and writes an
+// SSH exit-status back to the client.
+func runCommand(cmd string, channel ssh.Channel, reg *cookoo.Registry, router *cookoo.Router, cxt cookoo.Context) {
+	fields := strings.Fields(cmd)
+	if len(fields) != 1 {
+		fmt.Fprintf(channel.Stderr(), "illegal command: %q\n", cmd)
+		sendExitStatus(channel, 1)
+		return
+	}
+
+	route := "ssh" + strings.Title(fields[0])
+	if _, ok := reg.RouteSpec(route); !ok {
+		fmt.Fprintf(channel.Stderr(), "illegal command: %q\n", cmd)
+		sendExitStatus(channel, 1)
+		return
+	}
+
+	local := cxt.Copy()
+	local.Put("request", fields[0])
+	local.Put("channel", channel)
+
+	if err := router.HandleRequest(route, local, true); err != nil {
+		fmt.Fprintf(channel.Stderr(), "command failed: %s\n", err)
+		sendExitStatus(channel, 1)
+		return
+	}
+
+	sendExitStatus(channel, 0)
+}
+
+func sendExitStatus(channel ssh.Channel, code uint32) {
+	channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{code}))
+}
+
+// Ping is a cookoo command that writes "pong" to the session channel.
+//
+// Using:
+//   - request: the exec command string
+//   - channel: the ssh.Channel to write the response to
+//   - logger: the connection's scoped Logger
+func Ping(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+	channel := p.Get("channel", nil).(ssh.Channel)
+	logger, _ := p.Get("logger", nopLogger{}).(Logger)
+	logger.Debugf("ping")
+	io.WriteString(channel, "pong")
+	return true, nil
+}
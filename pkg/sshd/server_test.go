@@ -1,7 +1,20 @@
 package sshd
 
 import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
 	"testing"
 	"time"
 
@@ -32,7 +45,7 @@ func TestServer(t *testing.T) {
 	cfg.AddHostKey(key)
 
 	c := NewCircuit()
-	cxt := runServer(&cfg, c, t)
+	cxt := runServer(&cfg, c, t, serverOpts{})
 
 	// Give server time to initialize.
 	time.Sleep(200 * time.Millisecond)
@@ -79,17 +92,806 @@ func TestServer(t *testing.T) {
 	closer <- true
 }
 
+// TestFileAuthorizedKeys tests parsing of an authorized_keys file, including
+// comments and blank lines, and reload-on-write.
+func TestFileAuthorizedKeys(t *testing.T) {
+	signer := genTestingSigner(t)
+
+	dir, err := ioutil.TempDir("", "sshd-authorized-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/authorized_keys"
+	contents := "# a comment\n\n" + testingClientPubKey + "\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ak, err := NewFileAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ak.Close()
+
+	clientKey, _, _, _, err := ssh.ParseAuthorizedKey([]byte(testingClientPubKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ak.IsAuthorized("deis", clientKey) {
+		t.Fatal("expected fixture key to be authorized")
+	}
+	if ak.IsAuthorized("deis", signer.PublicKey()) {
+		t.Fatal("expected freshly generated key to be unauthorized")
+	}
+
+	// Rewrite the file to also authorize the freshly generated key, and
+	// confirm the watcher picks up the change.
+	contents += signer.PublicKey().Type() + " " + sshPublicKeyBase64(signer.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !ak.IsAuthorized("deis", signer.PublicKey()) {
+		if time.Now().After(deadline) {
+			t.Fatal("authorized_keys reload did not pick up the new key in time")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestFileAuthorizedKeysRenameReplace tests that the watcher survives
+// authorized_keys being replaced via a rename into place (the pattern used
+// by editors' backup-and-rename saves and atomic deploy scripts), rather
+// than only in-place writes.
+func TestFileAuthorizedKeysRenameReplace(t *testing.T) {
+	signer := genTestingSigner(t)
+
+	dir, err := ioutil.TempDir("", "sshd-authorized-keys-rename")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/authorized_keys"
+	contents := testingClientPubKey + "\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ak, err := NewFileAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ak.Close()
+
+	if ak.IsAuthorized("deis", signer.PublicKey()) {
+		t.Fatal("expected freshly generated key to be unauthorized before the rename")
+	}
+
+	// Write the new contents to a sibling file, then rename it over path,
+	// the way an editor save or an atomic deploy would replace the file.
+	newContents := contents + signer.PublicKey().Type() + " " + sshPublicKeyBase64(signer.PublicKey()) + "\n"
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, []byte(newContents), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(tmpPath, path); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for !ak.IsAuthorized("deis", signer.PublicKey()) {
+		if time.Now().After(deadline) {
+			t.Fatal("authorized_keys reload did not pick up a rename-replaced file in time")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// TestServerPublicKeyAuth tests that Serve enforces public-key
+// authentication when an AuthorizedKeys store is present on the context.
+func TestServerPublicKeyAuth(t *testing.T) {
+	authorizedSigner := genTestingSigner(t)
+	strangerSigner := genTestingSigner(t)
+
+	dir, err := ioutil.TempDir("", "sshd-authorized-keys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := dir + "/authorized_keys"
+	contents := authorizedSigner.PublicKey().Type() + " " + sshPublicKeyBase64(authorizedSigner.PublicKey()) + "\n"
+	if err := ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	ak, err := NewFileAuthorizedKeys(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ak.Close()
+
+	hostKey, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{}
+	cfg.AddHostKey(hostKey)
+
+	c := NewCircuit()
+	cxt := runServer(&cfg, c, t, serverOpts{
+		addr:           "127.0.0.1:2245",
+		authorizedKeys: ak,
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	authorizedClient, err := ssh.Dial("tcp", "127.0.0.1:2245", &ssh.ClientConfig{
+		User:            "deis",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(authorizedSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	})
+	if err != nil {
+		t.Fatalf("authorized client failed to connect: %s", err)
+	}
+	defer authorizedClient.Close()
+
+	sess, err := authorizedClient.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create client session: %s", err)
+	}
+	defer sess.Close()
+	if out, err := sess.Output("ping"); err != nil {
+		t.Errorf("Output '%s' Error %s", out, err)
+	} else if string(out) != "pong" {
+		t.Errorf("Expected 'pong', got '%s'", out)
+	}
+
+	if _, err := ssh.Dial("tcp", "127.0.0.1:2245", &ssh.ClientConfig{
+		User:            "deis",
+		Auth:            []ssh.AuthMethod{ssh.PublicKeys(strangerSigner)},
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}); err == nil {
+		t.Fatal("expected unauthorized client to be rejected")
+	}
+
+	closer := cxt.Get("sshd.Closer", nil).(chan interface{})
+	closer <- true
+}
+
+// TestServerLocalPortForwarding tests that a client can open a direct-tcpip
+// ("ssh -L") tunnel to a destination reachable from the server, once a
+// LocalPortForwardingCallback authorizes it.
+func TestServerLocalPortForwarding(t *testing.T) {
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello from upstream"))
+	}))
+	defer upstream.Close()
+
+	hostKey, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostKey)
+
+	c := NewCircuit()
+	cxt := runServer(&cfg, c, t, serverOpts{
+		addr: "127.0.0.1:2246",
+		localForwardCB: LocalPortForwardingCallback(
+			func(cookoo.Context, string, uint32) bool { return true },
+		),
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:2246", &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+
+	httpClient := &http.Client{
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return client.Dial(network, upstream.Listener.Addr().String())
+			},
+		},
+	}
+
+	resp, err := httpClient.Get("http://" + upstream.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to fetch over forwarded tunnel: %s", err)
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(body) != "hello from upstream" {
+		t.Errorf("Expected 'hello from upstream', got %q", body)
+	}
+
+	closer := cxt.Get("sshd.Closer", nil).(chan interface{})
+	closer <- true
+}
+
+// TestServerReversePortForwarding tests that a client can request a
+// tcpip-forward ("ssh -R") listener, receive forwarded-tcpip connections
+// made against it, and tear it down with cancel-tcpip-forward, once a
+// ReversePortForwardingCallback authorizes it.
+func TestServerReversePortForwarding(t *testing.T) {
+	hostKey, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostKey)
+
+	c := NewCircuit()
+	cxt := runServer(&cfg, c, t, serverOpts{
+		addr: "127.0.0.1:2252",
+		reverseForwardCB: ReversePortForwardingCallback(
+			func(cookoo.Context, string, uint32) bool { return true },
+		),
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:2252", &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+
+	listener, err := client.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to request reverse forwarding: %s", err)
+	}
+
+	const want = "hello from reverse tunnel"
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte(want))
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Failed to dial the forwarded listener: %s", err)
+	}
+	defer conn.Close()
+
+	got, err := ioutil.ReadAll(io.LimitReader(conn, int64(len(want))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != want {
+		t.Errorf("Expected %q over the reverse tunnel, got %q", want, got)
+	}
+
+	if err := listener.Close(); err != nil {
+		t.Fatalf("Failed to cancel reverse forwarding: %s", err)
+	}
+	if _, err := net.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Error("Expected the forwarded listener to be gone after cancel-tcpip-forward")
+	}
+
+	closer := cxt.Get("sshd.Closer", nil).(chan interface{})
+	closer <- true
+}
+
+// TestSessionSignals tests that a signal sent by the client while a
+// SessionHandler is running reaches a channel registered via Session.Signals,
+// proving handleRequests keeps servicing the requests channel concurrently
+// with the running handler rather than blocking on it.
+func TestSessionSignals(t *testing.T) {
+	hostKey, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(hostKey)
+
+	sigCh := make(chan ssh.Signal, 1)
+	stop := make(chan struct{})
+
+	c := NewCircuit()
+	cxt := runServer(&cfg, c, t, serverOpts{
+		addr: "127.0.0.1:2251",
+		sessionHandler: func(s Session) {
+			s.Signals(sigCh)
+			<-stop
+		},
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:2251", &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create client session: %s", err)
+	}
+	defer sess.Close()
+
+	if err := sess.Start("sleep"); err != nil {
+		t.Fatalf("Failed to start exec: %s", err)
+	}
+
+	// Give the server time to dispatch the handler and register Signals.
+	time.Sleep(200 * time.Millisecond)
+
+	if err := sess.Signal(ssh.SIGINT); err != nil {
+		t.Fatalf("Failed to send signal: %s", err)
+	}
+
+	select {
+	case sig := <-sigCh:
+		if sig != ssh.SIGINT {
+			t.Errorf("expected SIGINT, got %s", sig)
+		}
+	case <-time.After(1500 * time.Millisecond):
+		t.Fatal("expected the signal to be delivered to the running session handler")
+	}
+
+	close(stop)
+
+	closer := cxt.Get("sshd.Closer", nil).(chan interface{})
+	closer <- true
+}
+
+// TestCircuitShutdown tests that when a long-running exec command outlasts
+// its deadline, Shutdown returns an error near that deadline, leaves the
+// circuit Open, and force-closes the command's session.
+func TestCircuitShutdown(t *testing.T) {
+	key, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(key)
+
+	c := NewCircuit()
+	reg, router, cxt := cookoo.Cookoo()
+	cxt.Put(ServerConfig, &cfg)
+	cxt.Put(Address, "127.0.0.1:2247")
+	cxt.Put("cookoo.Router", router)
+
+	reg.AddRoute(cookoo.Route{
+		Name: "sshSleep",
+		Help: "Sleeps long enough to outlast a Shutdown deadline.",
+		Does: cookoo.Tasks{
+			cookoo.Cmd{
+				Name: "sleep",
+				Fn: func(c cookoo.Context, p *cookoo.Params) (interface{}, cookoo.Interrupt) {
+					time.Sleep(4 * time.Second)
+					return true, nil
+				},
+			},
+		},
+	})
+
+	go func() {
+		if err := Serve(reg, router, c, cxt); err != nil {
+			t.Fatalf("Failed serving with %s", err)
+		}
+	}()
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:2247", &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create client session: %s", err)
+	}
+	defer sess.Close()
+
+	if err := sess.Start("sleep"); err != nil {
+		t.Fatalf("Failed to start 'sleep': %s", err)
+	}
+
+	// Give the server time to register the session as in-flight.
+	time.Sleep(200 * time.Millisecond)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	shutdownStart := time.Now()
+	if err := c.Shutdown(ctx); err == nil {
+		t.Fatal("expected Shutdown to report the deadline was exceeded")
+	}
+	if elapsed := time.Since(shutdownStart); elapsed > 3*time.Second {
+		t.Fatalf("Shutdown took %s, expected to return near its 2s deadline", elapsed)
+	}
+
+	if c.State() != OpenState {
+		t.Fatalf("expected circuit to be Open after Shutdown, got %v", c.State())
+	}
+
+	// The sleeping command's connection should have been force-closed.
+	if err := sess.Wait(); err == nil {
+		t.Fatal("expected the sleeping session to end with an error after forced shutdown")
+	}
+}
+
+// TestRateLimiterBanlist tests that enough failed-auth attempts from one IP
+// within the configured window bans it and publishes it on the banlist.
+func TestRateLimiterBanlist(t *testing.T) {
+	rl := NewRateLimiter(RateLimits{
+		MaxFailedAuth:    3,
+		FailedAuthWindow: time.Second,
+		BanDuration:      time.Minute,
+	})
+
+	for i := 0; i < 2; i++ {
+		rl.RecordFailedAuth("10.0.0.1")
+	}
+	if rl.isBanned("10.0.0.1") {
+		t.Fatal("expected 10.0.0.1 not yet banned after 2 failures")
+	}
+
+	rl.RecordFailedAuth("10.0.0.1")
+	if !rl.isBanned("10.0.0.1") {
+		t.Fatal("expected 10.0.0.1 banned after 3 failures")
+	}
+
+	select {
+	case ip := <-rl.Banlist():
+		if ip != "10.0.0.1" {
+			t.Errorf("expected banlist to report 10.0.0.1, got %s", ip)
+		}
+	default:
+		t.Fatal("expected a ban to be published on the banlist channel")
+	}
+
+	if rl.AllowConnection("10.0.0.1") {
+		t.Fatal("expected banned IP to be rejected by AllowConnection")
+	}
+}
+
+// TestServerRateLimiting tests that the accept loop caps concurrent
+// handshakes: connections beyond MaxConcurrentHandshakes are closed
+// immediately rather than left to compete for a handshake slot.
+func TestServerRateLimiting(t *testing.T) {
+	key, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(key)
+
+	c := NewCircuit()
+	runServer(&cfg, c, t, serverOpts{
+		addr: "127.0.0.1:2250",
+		rateLimits: &RateLimits{
+			PerIPRate:               1e6,
+			PerIPBurst:              1000,
+			MaxConcurrentHandshakes: 3,
+			HandshakeTimeout:        300 * time.Millisecond,
+		},
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	const dials = 10
+	conns := make([]net.Conn, 0, dials)
+	for i := 0; i < dials; i++ {
+		conn, err := net.Dial("tcp", "127.0.0.1:2250")
+		if err != nil {
+			t.Fatalf("dial %d failed: %s", i, err)
+		}
+		conns = append(conns, conn)
+	}
+	defer func() {
+		for _, conn := range conns {
+			conn.Close()
+		}
+	}()
+
+	// None of these connections speak the SSH protocol, so any that got a
+	// handshake slot are still open; any rejected outright by the rate
+	// limiter are already closed by the server.
+	time.Sleep(100 * time.Millisecond)
+
+	rejected := 0
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+		buf := make([]byte, 1)
+		_, err := conn.Read(buf)
+		if err != nil {
+			rejected++
+		}
+	}
+
+	if want := dials - 3; rejected != want {
+		t.Errorf("expected %d connections rejected outright, got %d", want, rejected)
+	}
+}
+
+// TestHostKeyRotation tests that rotating the host key directory affects
+// only new connections: an already-handshaked client keeps working, while a
+// fresh dial observes the new host key fingerprint.
+func TestHostKeyRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "sshd-hostkeys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := ioutil.WriteFile(dir+"/id_rsa", []byte(testingHostKey), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+
+	c := NewCircuit()
+	cxt := runServer(&cfg, c, t, serverOpts{
+		addr:       "127.0.0.1:2249",
+		hostKeyDir: dir,
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	var oldFingerprint string
+	client, err := ssh.Dial("tcp", "127.0.0.1:2249", &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			oldFingerprint = ssh.FingerprintSHA256(key)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+
+	newKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	newPEM := pem.EncodeToMemory(&pem.Block{
+		Type:  "RSA PRIVATE KEY",
+		Bytes: x509.MarshalPKCS1PrivateKey(newKey),
+	})
+	if err := ioutil.WriteFile(dir+"/id_rsa_new", newPEM, 0600); err != nil {
+		t.Fatal(err)
+	}
+	// The old key file is removed so the new key is unambiguously the one
+	// selected for fresh connections.
+	if err := os.Remove(dir + "/id_rsa"); err != nil {
+		t.Fatal(err)
+	}
+
+	store, ok := cxt.Get(HostKeyStoreKey, nil).(*HostKeyStore)
+	if !ok {
+		t.Fatal("expected Serve to publish a *HostKeyStore on the context")
+	}
+	if err := store.RotateHostKeys(dir); err != nil {
+		t.Fatalf("RotateHostKeys failed: %s", err)
+	}
+
+	// The already-handshaked client keeps working against the old key.
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("existing client session failed after rotation: %s", err)
+	}
+	defer sess.Close()
+	if out, err := sess.Output("ping"); err != nil {
+		t.Errorf("Output '%s' Error %s", out, err)
+	} else if string(out) != "pong" {
+		t.Errorf("Expected 'pong', got '%s'", out)
+	}
+
+	// A fresh dial observes the new host key.
+	var newFingerprint string
+	freshClient, err := ssh.Dial("tcp", "127.0.0.1:2249", &ssh.ClientConfig{
+		HostKeyCallback: func(hostname string, remote net.Addr, key ssh.PublicKey) error {
+			newFingerprint = ssh.FingerprintSHA256(key)
+			return nil
+		},
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect fresh client after rotation: %s", err)
+	}
+	defer freshClient.Close()
+
+	if newFingerprint == oldFingerprint {
+		t.Fatal("expected fresh dial to observe a rotated host key fingerprint")
+	}
+
+	closer := cxt.Get("sshd.Closer", nil).(chan interface{})
+	closer <- true
+}
+
+// TestServerLogging tests that a Logger set on the top-level context is
+// given per-connection fields and reaches cookoo commands via cxt:logger.
+func TestServerLogging(t *testing.T) {
+	key, err := sshTestingHostKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := ssh.ServerConfig{NoClientAuth: true}
+	cfg.AddHostKey(key)
+
+	logger := &fakeLogger{}
+
+	c := NewCircuit()
+	cxt := runServer(&cfg, c, t, serverOpts{
+		addr:   "127.0.0.1:2248",
+		logger: logger,
+	})
+	time.Sleep(200 * time.Millisecond)
+
+	client, err := ssh.Dial("tcp", "127.0.0.1:2248", &ssh.ClientConfig{})
+	if err != nil {
+		t.Fatalf("Failed to connect client to local server: %s", err)
+	}
+	defer client.Close()
+
+	sess, err := client.NewSession()
+	if err != nil {
+		t.Fatalf("Failed to create client session: %s", err)
+	}
+	defer sess.Close()
+
+	if out, err := sess.Output("ping"); err != nil {
+		t.Errorf("Output '%s' Error %s", out, err)
+	} else if string(out) != "pong" {
+		t.Errorf("Expected 'pong', got '%s'", out)
+	}
+
+	logger.mu.Lock()
+	defer logger.mu.Unlock()
+
+	if len(logger.withCalls) == 0 {
+		t.Fatal("expected the connection to derive a child logger via With")
+	}
+	fields := logger.withCalls[0]
+	for _, want := range []string{"remote_addr", "session_id", "user", "client_version"} {
+		found := false
+		for _, f := range fields {
+			if f == want {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected connection logger fields to include %q, got %v", want, fields)
+		}
+	}
+
+	found := false
+	for _, line := range logger.debugLines {
+		if line == "ping" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("expected Ping to log a debug line, got %v", logger.debugLines)
+	}
+
+	closer := cxt.Get("sshd.Closer", nil).(chan interface{})
+	closer <- true
+}
+
+// fakeLogger is a Logger that records calls for assertions.
+type fakeLogger struct {
+	mu         sync.Mutex
+	withCalls  [][]string
+	debugLines []string
+}
+
+func (f *fakeLogger) With(kv ...interface{}) Logger {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var keys []string
+	for i := 0; i+1 < len(kv); i += 2 {
+		if k, ok := kv[i].(string); ok {
+			keys = append(keys, k)
+		}
+	}
+	f.withCalls = append(f.withCalls, keys)
+	return f
+}
+
+func (f *fakeLogger) Debugf(format string, args ...interface{}) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.debugLines = append(f.debugLines, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeLogger) Infof(format string, args ...interface{})  {}
+func (f *fakeLogger) Errorf(format string, args ...interface{}) {}
+
+// genTestingSigner generates a fresh, throwaway RSA key pair for tests that
+// need a client identity distinct from testingHostKey/testingClientPubKey.
+func genTestingSigner(t *testing.T) ssh.Signer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+// sshPublicKeyBase64 renders key in the base64 form used in authorized_keys
+// files (i.e. without the "ssh-rsa " prefix or trailing comment).
+func sshPublicKeyBase64(key ssh.PublicKey) string {
+	return base64.StdEncoding.EncodeToString(key.Marshal())
+}
+
 // sshTestingHostKey loads the testing key.
 func sshTestingHostKey() (ssh.Signer, error) {
 	return ssh.ParsePrivateKey([]byte(testingHostKey))
 }
 
-func runServer(config *ssh.ServerConfig, c *Circuit, t *testing.T) cookoo.Context {
+// serverOpts configures the fixture server runServer starts. The zero value
+// reproduces runServer's original behavior: testingServerAddr, no
+// auth/rate-limiting/logging, and only the "ping" route.
+type serverOpts struct {
+	addr             string
+	authorizedKeys   AuthorizedKeys
+	hostKeyDir       string
+	rateLimits       *RateLimits
+	logger           Logger
+	localForwardCB   LocalPortForwardingCallback
+	reverseForwardCB ReversePortForwardingCallback
+	sessionHandler   SessionHandler
+}
+
+func runServer(config *ssh.ServerConfig, c *Circuit, t *testing.T, opts serverOpts) cookoo.Context {
 	reg, router, cxt := cookoo.Cookoo()
+
+	addr := opts.addr
+	if addr == "" {
+		addr = testingServerAddr
+	}
 	cxt.Put(ServerConfig, config)
-	cxt.Put(Address, testingServerAddr)
+	cxt.Put(Address, addr)
 	cxt.Put("cookoo.Router", router)
 
+	if opts.authorizedKeys != nil {
+		cxt.Put(AuthorizedKeysKey, opts.authorizedKeys)
+	}
+	if opts.hostKeyDir != "" {
+		cxt.Put(HostKeyDirKey, opts.hostKeyDir)
+	}
+	if opts.rateLimits != nil {
+		cxt.Put(RateLimitsKey, *opts.rateLimits)
+	}
+	if opts.logger != nil {
+		cxt.Put(LoggerKey, opts.logger)
+	}
+	if opts.localForwardCB != nil {
+		cxt.Put(LocalPortForwardingCallbackKey, opts.localForwardCB)
+	}
+	if opts.reverseForwardCB != nil {
+		cxt.Put(ReversePortForwardingCallbackKey, opts.reverseForwardCB)
+	}
+	if opts.sessionHandler != nil {
+		cxt.Put(SessionHandlerKey, opts.sessionHandler)
+	}
+
 	reg.AddRoute(cookoo.Route{
 		Name: "sshPing",
 		Help: "Handles an ssh exec ping.",
@@ -100,6 +902,7 @@ func runServer(config *ssh.ServerConfig, c *Circuit, t *testing.T) cookoo.Contex
 				Using: []cookoo.Param{
 					{Name: "request", From: "cxt:request"},
 					{Name: "channel", From: "cxt:channel"},
+					{Name: "logger", From: "cxt:logger"},
 				},
 			},
 		},
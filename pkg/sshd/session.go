@@ -0,0 +1,275 @@
+package sshd
+
+import (
+	"sync"
+
+	"golang.org/x/crypto/ssh"
+)
+
+// SessionHandler is invoked once per "session" channel when one is
+// registered on the context under SessionHandlerKey. It replaces the
+// legacy cookoo exec-route dispatch and is handed the full parsed Session,
+// gliderlabs/ssh-style, so it can serve exec, shell, and subsystem requests
+// uniformly.
+type SessionHandler func(s Session)
+
+// Window represents the dimensions of a terminal.
+type Window struct {
+	Width  int
+	Height int
+}
+
+// Pty describes a requested pseudo-terminal.
+type Pty struct {
+	Term   string
+	Window Window
+}
+
+// Session represents an SSH session channel together with the exec/shell,
+// pty, environment, and signal requests that arrived on it.
+type Session interface {
+	ssh.Channel
+
+	// User is the authenticated username for the connection this session
+	// belongs to.
+	User() string
+
+	// RawCommand is the raw command string from an "exec" request, or ""
+	// for a "shell" request.
+	RawCommand() string
+
+	// Command is RawCommand split on shell-style words.
+	Command() []string
+
+	// Subsystem is the name requested by a "subsystem" request, or "".
+	Subsystem() string
+
+	// Environ is the set of "name=value" strings set via "env" requests.
+	Environ() []string
+
+	// Pty returns the requested pty and a channel of window-change events,
+	// if the client sent a "pty-req".
+	Pty() (Pty, <-chan Window, bool)
+
+	// Signals starts forwarding incoming SSH signal requests onto c. Passing
+	// a nil channel stops forwarding.
+	Signals(c chan<- ssh.Signal)
+}
+
+// session implements Session on top of an accepted ssh.Channel.
+type session struct {
+	ssh.Channel
+
+	conn *ssh.ServerConn
+
+	mu        sync.Mutex
+	env       []string
+	rawCmd    string
+	subsystem string
+	pty       *Pty
+	winch     chan Window
+	sigCh     chan<- ssh.Signal
+}
+
+func (s *session) User() string { return s.conn.User() }
+
+func (s *session) RawCommand() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.rawCmd
+}
+
+func (s *session) Command() []string {
+	return parseShellWords(s.RawCommand())
+}
+
+func (s *session) Subsystem() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.subsystem
+}
+
+func (s *session) Environ() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	env := make([]string, len(s.env))
+	copy(env, s.env)
+	return env
+}
+
+func (s *session) Pty() (Pty, <-chan Window, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pty == nil {
+		return Pty{}, nil, false
+	}
+	return *s.pty, s.winch, true
+}
+
+func (s *session) Signals(c chan<- ssh.Signal) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sigCh = c
+}
+
+// handleRequests consumes the session channel's requests, updating session
+// state, until an "exec"/"shell"/"subsystem" request arrives. At that point
+// it runs start in its own goroutine and keeps servicing later requests
+// (env, pty-req, window-change, signal) concurrently, so a live
+// window-change or Signals() delivery during a long-running command still
+// reaches the session. RFC 4254 permits only one exec/shell/subsystem
+// request per channel, so a second one is rejected rather than starting a
+// second handler. handleRequests returns once start's goroutine finishes (or
+// immediately, if the channel closes before anything was started), so the
+// caller's deferred channel.Close() runs and the client sees the channel
+// end.
+func (s *session) handleRequests(requests <-chan *ssh.Request, start func(s *session)) {
+	started := false
+	done := make(chan struct{})
+
+	startHandler := func() {
+		started = true
+		go func() {
+			start(s)
+			close(done)
+		}()
+	}
+
+	for {
+		select {
+		case req, ok := <-requests:
+			if !ok {
+				if !started {
+					return
+				}
+				// The handler is still running; stop servicing requests
+				// but keep waiting for it to finish below.
+				requests = nil
+				continue
+			}
+
+			switch req.Type {
+			case "exec":
+				if started {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Command string }
+				ssh.Unmarshal(req.Payload, &payload)
+				s.mu.Lock()
+				s.rawCmd = payload.Command
+				s.mu.Unlock()
+				req.Reply(true, nil)
+				startHandler()
+
+			case "shell":
+				if started {
+					req.Reply(false, nil)
+					continue
+				}
+				req.Reply(true, nil)
+				startHandler()
+
+			case "subsystem":
+				if started {
+					req.Reply(false, nil)
+					continue
+				}
+				var payload struct{ Name string }
+				ssh.Unmarshal(req.Payload, &payload)
+				s.mu.Lock()
+				s.subsystem = payload.Name
+				s.mu.Unlock()
+				req.Reply(true, nil)
+				startHandler()
+
+			case "env":
+				var payload struct{ Name, Value string }
+				ssh.Unmarshal(req.Payload, &payload)
+				s.mu.Lock()
+				s.env = append(s.env, payload.Name+"="+payload.Value)
+				s.mu.Unlock()
+				req.Reply(true, nil)
+
+			case "pty-req":
+				var payload struct {
+					Term                               string
+					Width, Height, PixWidth, PixHeight uint32
+					Modes                              string
+				}
+				ssh.Unmarshal(req.Payload, &payload)
+				s.mu.Lock()
+				s.pty = &Pty{Term: payload.Term, Window: Window{Width: int(payload.Width), Height: int(payload.Height)}}
+				s.winch = make(chan Window, 1)
+				s.mu.Unlock()
+				req.Reply(true, nil)
+
+			case "window-change":
+				var payload struct{ Width, Height, PixWidth, PixHeight uint32 }
+				ssh.Unmarshal(req.Payload, &payload)
+				s.mu.Lock()
+				if s.pty != nil {
+					s.pty.Window = Window{Width: int(payload.Width), Height: int(payload.Height)}
+					if s.winch != nil {
+						select {
+						case s.winch <- s.pty.Window:
+						default:
+						}
+					}
+				}
+				s.mu.Unlock()
+
+			case "signal":
+				var payload struct{ Name string }
+				ssh.Unmarshal(req.Payload, &payload)
+				s.mu.Lock()
+				sigCh := s.sigCh
+				s.mu.Unlock()
+				if sigCh != nil {
+					select {
+					case sigCh <- ssh.Signal(payload.Name):
+					default:
+					}
+				}
+
+			default:
+				if req.WantReply {
+					req.Reply(false, nil)
+				}
+			}
+
+		case <-done:
+			return
+		}
+	}
+}
+
+// parseShellWords splits cmd the way a shell would split simple
+// double-quoted or unquoted words; it is intentionally small and does not
+// attempt full shell-quoting semantics.
+func parseShellWords(cmd string) []string {
+	var words []string
+	var cur []rune
+	inQuotes := false
+
+	flush := func() {
+		if len(cur) > 0 {
+			words = append(words, string(cur))
+			cur = nil
+		}
+	}
+
+	for _, r := range cmd {
+		switch {
+		case r == '"':
+			inQuotes = !inQuotes
+		case r == ' ' && !inQuotes:
+			flush()
+		default:
+			cur = append(cur, r)
+		}
+	}
+	flush()
+
+	return words
+}